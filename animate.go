@@ -0,0 +1,43 @@
+package neuquant
+
+import (
+	"image"
+	"image/color"
+)
+
+// AddFrame appends img's pixels to the quantizer's training set. Call it
+// once for each frame of an animation before calling Palette, so that the
+// trained network is shared across every frame and successive frames don't
+// flicker against each other.
+func (q *Quantizer) AddFrame(img image.Image) {
+	b := img.Bounds()
+	q.pixels = append(q.pixels, sample(img, b.Dx()*b.Dy()/q.sampleFac)...)
+}
+
+// Palette trains the network over every frame added so far via AddFrame and
+// returns the resulting shared palette. The learn schedule is spread over
+// the pixels sampled from all frames combined, rather than being restarted
+// for each one. It must be called after the frames are added and before
+// MapFrame.
+func (q *Quantizer) Palette() color.Palette {
+	q.allocate(q.numColors)
+	if q.arithmetic == FloatArithmetic {
+		q.setUpArrays()
+		q.learn()
+		q.fix()
+	} else {
+		q.setUpArraysInt()
+		q.learnInt()
+		q.fixInt()
+	}
+	q.inxBuild()
+	return makePalette(q.colorMap)
+}
+
+// MapFrame produces an indexed image.Paletted for img against the shared
+// palette produced by Palette. It must be called after Palette.
+func (q *Quantizer) MapFrame(img image.Image) *image.Paletted {
+	dst := image.NewPaletted(img.Bounds(), makePalette(q.colorMap))
+	q.DrawPaletted(dst, img)
+	return dst
+}
@@ -0,0 +1,216 @@
+package neuquant
+
+const (
+	netBiasShift = 4 // Bias for network color values, i.e. 1/16th fractions.
+
+	intBiasShift = 16 // Bias for fractions.
+	intBias      = 1 << intBiasShift
+
+	gammaShiftInt = 10 // intGamma = 1024, matching the float gamma.
+	betaShiftInt  = 10 // intBeta = 1/1024, matching the float beta.
+	intBeta       = intBias >> betaShiftInt
+	intBetaGamma  = intBias << (gammaShiftInt - betaShiftInt)
+
+	radBiasShiftInt = 8
+	radBiasInt      = 1 << radBiasShiftInt
+)
+
+// Arithmetic selects the numeric representation used internally by the
+// learning algorithm.
+type Arithmetic int
+
+const (
+	// IntegerArithmetic uses Dekker's original fixed-point integer scheme,
+	// as also used by the libgd neuquant port: network values are scaled
+	// by netBiasShift and freq/bias are scaled by intBiasShift. It is the
+	// default.
+	IntegerArithmetic Arithmetic = iota
+
+	// FloatArithmetic uses plain float64 arithmetic throughout. It is kept
+	// for comparison against IntegerArithmetic. The two agree to within ±1
+	// per channel on the initial network and on a single learning step;
+	// fully trained palettes are not held to ±1 per channel, since rounding
+	// differences between the two compound over the learning cycles.
+	FloatArithmetic
+)
+
+func (q *Quantizer) setUpArraysInt() {
+	q.networkInt[0] = [3]int32{} // Black.
+
+	white := int32(255) << netBiasShift
+	q.networkInt[1] = [3]int32{white, white, white}
+
+	initFreq := int32(intBias / q.size)
+	for i := 0; i < specials; i++ {
+		q.freqInt[i] = initFreq
+		q.biasInt[i] = 0
+	}
+
+	cutNetSize := int32(q.size - specials)
+	for i := specials; i < q.size; i++ {
+		v := (int32(i-specials) * 255 << netBiasShift) / cutNetSize
+		q.networkInt[i] = [3]int32{v, v, v}
+
+		q.freqInt[i] = initFreq
+		q.biasInt[i] = 0
+	}
+}
+
+func (q *Quantizer) learnInt() {
+	initRad := q.size / 8
+	if initRad < 1 {
+		initRad = 1
+	}
+	initBiasRad := initRad * radBiasInt
+
+	biasRad := initBiasRad
+	alphaDec := 30 + ((q.sampleFac - 1) / 3)
+	samplePixels := len(q.pixels) / 3
+	delta := samplePixels / numCycles
+	if delta < 1 {
+		delta = 1
+	}
+	alpha := initAlpha
+
+	rad := calcRadInt(biasRad)
+
+	i, pos := 0, 0
+	for i < samplePixels {
+		o := pos * 3
+		red := int32(q.pixels[o]) << netBiasShift
+		green := int32(q.pixels[o+1]) << netBiasShift
+		blue := int32(q.pixels[o+2]) << netBiasShift
+
+		// Remember background color.
+		if bgColor := specials - 1; i == 0 {
+			q.networkInt[bgColor] = [3]int32{red, green, blue}
+		}
+
+		j := q.specialFindInt(red, green, blue)
+		if j < 0 {
+			j = q.contestInt(red, green, blue)
+		}
+
+		// Don't learn for specials.
+		if j >= specials {
+			q.alterSingleInt(alpha, j, red, green, blue)
+			if rad > 0 {
+				q.alterNeighborsInt(alpha, rad, j, red, green, blue)
+			}
+		}
+
+		pos++
+		if pos >= samplePixels {
+			pos = 0
+		}
+
+		i++
+		if i%delta == 0 {
+			alpha -= alpha / alphaDec
+			biasRad -= biasRad / radDec
+			rad = calcRadInt(biasRad)
+		}
+	}
+}
+
+func (q *Quantizer) fixInt() {
+	for i := 0; i < q.size; i++ {
+		p := q.networkInt[i]
+		for j := 0; j < 3; j++ {
+			q.colorMap[i][j] = roundToColorValue(float64(p[j]) / float64(int32(1)<<netBiasShift))
+		}
+	}
+}
+
+// Move neuron i towards (r, g, b).
+func (q *Quantizer) alterSingleInt(alpha, i int, r, g, b int32) {
+	p := &q.networkInt[i]
+	p[0] -= int32(alpha) * (p[0] - r) / initAlpha
+	p[1] -= int32(alpha) * (p[1] - g) / initAlpha
+	p[2] -= int32(alpha) * (p[2] - b) / initAlpha
+}
+
+// Move all neurons that are at most rad away from i towards (r, g, b).
+func (q *Quantizer) alterNeighborsInt(alpha, rad, i int, r, g, b int32) {
+	lo, hi := i-rad, i+rad
+	if lo < specials {
+		lo = specials - 1
+	}
+	if hi > q.size {
+		hi = q.size
+	}
+
+	j, k := i+1, i-1
+	var c int
+	for (j < hi) || (k > lo) {
+		a := int32(alpha*(rad*rad-c*c)) / int32(rad*rad)
+		c++
+		if j < hi {
+			p := &q.networkInt[j]
+			p[0] -= a * (p[0] - r) / initAlpha
+			p[1] -= a * (p[1] - g) / initAlpha
+			p[2] -= a * (p[2] - b) / initAlpha
+			j++
+		}
+		if k > lo {
+			p := &q.networkInt[k]
+			p[0] -= a * (p[0] - r) / initAlpha
+			p[1] -= a * (p[1] - g) / initAlpha
+			p[2] -= a * (p[2] - b) / initAlpha
+			k--
+		}
+	}
+}
+
+// contestInt mirrors contest, in the scaled integer domain: bias is kept
+// biased by intBiasShift and is rescaled down to netBiasShift before being
+// subtracted from the (netBiasShift-scaled) distance.
+func (q *Quantizer) contestInt(r, g, b int32) int {
+	var bestDist, bestBiasDist int64 = 1 << 62, 1 << 62
+	bestPos, bestBiasPos := -1, -1
+
+	for i := specials; i < q.size; i++ {
+		p := &q.networkInt[i]
+		dist := int64(iabs32(p[0]-r)) + int64(iabs32(p[1]-g)) + int64(iabs32(p[2]-b))
+		if dist < bestDist {
+			bestDist = dist
+			bestPos = i
+		}
+		biasDist := dist - int64(q.biasInt[i]>>(intBiasShift-netBiasShift))
+		if biasDist < bestBiasDist {
+			bestBiasDist = biasDist
+			bestBiasPos = i
+		}
+		betaFreq := q.freqInt[i] >> betaShiftInt
+		q.freqInt[i] -= betaFreq
+		q.biasInt[i] += betaFreq << gammaShiftInt
+	}
+	q.freqInt[bestPos] += intBeta
+	q.biasInt[bestPos] -= intBetaGamma
+	return bestBiasPos
+}
+
+func (q *Quantizer) specialFindInt(r, g, b int32) int {
+	for i := 0; i < specials; i++ {
+		p := &q.networkInt[i]
+		if p[0] == r && p[1] == g && p[2] == b {
+			return i
+		}
+	}
+	return -1
+}
+
+func calcRadInt(bias int) int {
+	rad := bias >> radBiasShiftInt
+	if rad <= 1 {
+		rad = 0
+	}
+	return rad
+}
+
+func iabs32(x int32) int32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
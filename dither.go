@@ -0,0 +1,90 @@
+package neuquant
+
+import "image"
+
+// Ditherer selects the error diffusion algorithm used by
+// Quantizer.DrawPaletted when mapping an image to a palette.
+type Ditherer int
+
+const (
+	// NoDither maps each pixel to the closest palette entry independently.
+	NoDither Ditherer = iota
+
+	// FloydSteinberg diffuses each pixel's quantization error to its
+	// neighbors using the standard serpentine Floyd–Steinberg weights
+	// (7/16 ahead, 3/16 down-behind, 5/16 down, 1/16 down-ahead),
+	// alternating scan direction every row so error does not
+	// accumulate preferentially to one side.
+	FloydSteinberg
+)
+
+// ditherFloydSteinberg draws src into dst using serpentine Floyd–Steinberg
+// error diffusion against the palette looked up through mp. It keeps only
+// two rows of per-channel float error live at a time.
+func ditherFloydSteinberg(dst *image.Paletted, src image.Image, mp *Mapper) {
+	b := src.Bounds()
+	w := b.Dx()
+	if w == 0 {
+		return
+	}
+
+	// cur and next hold accumulated error for the row being drawn and the
+	// row below it, indexed by (x - b.Min.X + 1) so that writing one
+	// column past either edge never goes out of bounds.
+	cur := make([][3]float64, w+2)
+	next := make([][3]float64, w+2)
+
+	leftToRight := true
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for i := range next {
+			next[i] = [3]float64{}
+		}
+
+		xs, xe, dx := 0, w, 1
+		if !leftToRight {
+			xs, xe, dx = w-1, -1, -1
+		}
+		for x := xs; x != xe; x += dx {
+			px := b.Min.X + x
+			r0, g0, b0, _ := src.At(px, y).RGBA()
+			r := float64(r0>>8) + cur[x+1][0]
+			g := float64(g0>>8) + cur[x+1][1]
+			bl := float64(b0>>8) + cur[x+1][2]
+
+			idx, p := mp.index(clamp255(r), clamp255(g), clamp255(bl))
+			dst.SetColorIndex(px, y, idx)
+
+			er := r - float64(p[0])
+			eg := g - float64(p[1])
+			eb := bl - float64(p[2])
+
+			addErr(cur, x+1+dx, er, eg, eb, 7.0/16.0)
+			addErr(next, x+1-dx, er, eg, eb, 3.0/16.0)
+			addErr(next, x+1, er, eg, eb, 5.0/16.0)
+			addErr(next, x+1+dx, er, eg, eb, 1.0/16.0)
+		}
+
+		cur, next = next, cur
+		leftToRight = !leftToRight
+	}
+}
+
+func addErr(buf [][3]float64, i int, er, eg, eb, weight float64) {
+	if i < 0 || i >= len(buf) {
+		return
+	}
+	buf[i][0] += er * weight
+	buf[i][1] += eg * weight
+	buf[i][2] += eb * weight
+}
+
+func clamp255(x float64) int {
+	i := int(x + 0.5)
+	if i < 0 {
+		return 0
+	}
+	if i > 255 {
+		return 255
+	}
+	return i
+}
@@ -0,0 +1,94 @@
+package neuquant
+
+import (
+	"image"
+	"image/color"
+)
+
+// Mapper maps colors to the palette produced by a prior call to
+// Quantizer.Quantize. It uses the sorted netIndex lookup built by inxBuild
+// to limit the search for the closest network neuron to those near the
+// target's green channel, which is considerably faster than the linear
+// scan performed by color.Palette.Index.
+type Mapper struct {
+	colorMap [][3]int
+	netIndex [maxNetSize]int
+}
+
+// Mapper returns a Mapper for the palette produced by the most recent call
+// to q.Quantize. It must not be called before Quantize.
+func (q *Quantizer) Mapper() *Mapper {
+	return &Mapper{colorMap: q.colorMap, netIndex: q.netIndex}
+}
+
+// Index returns the index of the palette entry closest to c.
+func (mp *Mapper) Index(c color.Color) uint8 {
+	r32, g32, b32, _ := c.RGBA()
+	idx, _ := mp.index(int(r32>>8), int(g32>>8), int(b32>>8))
+	return idx
+}
+
+// index returns the index of the palette entry closest to the (r, g, b)
+// triple, along with that entry's own (r, g, b) triple, by looking up g in
+// netIndex and walking outward through the green-sorted network until the
+// remaining green gap exceeds the best Manhattan distance found so far.
+func (mp *Mapper) index(r, g, b int) (uint8, [3]int) {
+	n := len(mp.colorMap)
+	up, down := mp.netIndex[g], mp.netIndex[g]-1
+
+	best := 0
+	bestDist := int(^uint(0) >> 1) // max int
+
+	for up < n || down >= 0 {
+		if up < n {
+			p := &mp.colorMap[up]
+			if gap := p[1] - g; gap >= bestDist {
+				up = n
+			} else {
+				if dist := iabs(p[0]-r) + iabs(p[1]-g) + iabs(p[2]-b); dist < bestDist {
+					bestDist, best = dist, up
+				}
+				up++
+			}
+		}
+		if down >= 0 {
+			p := &mp.colorMap[down]
+			if gap := g - p[1]; gap >= bestDist {
+				down = -1
+			} else {
+				if dist := iabs(p[0]-r) + iabs(p[1]-g) + iabs(p[2]-b); dist < bestDist {
+					bestDist, best = dist, down
+				}
+				down--
+			}
+		}
+	}
+	return uint8(best), mp.colorMap[best]
+}
+
+// DrawPaletted fills dst with src, quantized to the palette produced by the
+// most recent call to q.Quantize. It uses a Mapper internally and is the
+// preferred way to produce the *image.Paletted that encoders such as
+// image/gif expect, since it avoids the per-pixel cost of
+// color.Palette.Index. When q was constructed with Options.Dither set, the
+// quantization error is diffused to neighboring pixels as it draws.
+func (q *Quantizer) DrawPaletted(dst *image.Paletted, src image.Image) {
+	mp := q.Mapper()
+	if q.dither == FloydSteinberg {
+		ditherFloydSteinberg(dst, src, mp)
+		return
+	}
+	b := src.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.SetColorIndex(x, y, mp.Index(src.At(x, y)))
+		}
+	}
+}
+
+func iabs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -25,7 +25,6 @@ that this copyright notice remain intact.
 package neuquant
 
 import (
-	"errors"
 	"image"
 	"image/color"
 	"image/draw"
@@ -35,13 +34,11 @@ import (
 const (
 	numCycles = 100 // Number of learning cycles.
 
-	netSize  = 256 // Number of colors used.
-	specials = 3   // Number of reserved colors used.
+	maxNetSize = 256 // Maximum number of colors supported.
+	specials   = 3   // Number of reserved colors used.
 
-	initRad      = netSize / 8 // For 256 colors, radius starts at 32.
 	radBiasShift = 6
 	radBias      = 1 << radBiasShift
-	initBiasRad  = initRad * radBias
 	radDec       = 30 // Factor of 1/30 each cycle.
 
 	alphaBiasShift = 10
@@ -49,68 +46,136 @@ const (
 
 	beta  = 1.0 / 1024.0
 	gamma = 1024.0
-
-	// Four primes near 500 - assume no image has a length so large
-	// that it is divisible by all four primes.
-	prime1 = 499
-	prime2 = 491
-	prime3 = 487
-	prime4 = 503
 )
 
+// Options configures a Quantizer returned by NewWithOptions.
+type Options struct {
+	// NumColors is the size of the network, i.e. the number of colors the
+	// quantizer will produce. It must be in the range [4,256]. Smaller
+	// values are useful for small animations, icons, or bandwidth
+	// constrained GIFs.
+	NumColors int
+
+	// SamplingFactor must be in the range [1,30]. Higher numbers reduce
+	// computation time at the expense of image quality.
+	SamplingFactor int
+
+	// Dither selects the error diffusion applied by Quantizer.DrawPaletted.
+	// The default, NoDither, maps each pixel to the closest palette entry
+	// independently.
+	Dither Ditherer
+
+	// Arithmetic selects the numeric representation used internally by the
+	// learning algorithm. The default, IntegerArithmetic, is substantially
+	// faster on large images since the per-pixel contest loop is O(size).
+	Arithmetic Arithmetic
+}
+
 // Quantizer is a Kohonen neural network color quantizer, used to
 // quantize an image into, at most, 256 distinct colors. It implements the
 // draw.Quantizer interface. Useful for encoding images in the GIF image format.
-type quantizer struct {
-	sampleFac int
+type Quantizer struct {
+	numColors  int // The configured NumColors, immutable after construction.
+	size       int // Number of colors used by the current call, a.k.a. the network size.
+	sampleFac  int
+	dither     Ditherer
+	arithmetic Arithmetic
+
+	network  [][3]float64 // The network itself, used by FloatArithmetic.
+	colorMap [][3]int
 
-	network  [netSize][3]float64 // The network itself.
-	colorMap [netSize][3]int
+	networkInt [][3]int32 // The network itself, used by IntegerArithmetic.
 
-	netIndex [256]int // For network lookup.
+	netIndex [maxNetSize]int // For network lookup.
 
-	bias, freq [netSize]float64
+	bias, freq []float64
+	biasInt    []int32
+	freqInt    []int32
 
-	pixels []int
+	pixels []uint8 // Sampled training pixels, as consecutive RGB triples.
 }
 
 // New returns a new Kohonen neural network color quantizer with a sampling
-// factor of 1 (best quality).
+// factor of 1 (best quality) and a palette of 256 colors.
 func New() draw.Quantizer {
-	return NewWithSamplingFactor(1)
+	return NewWithOptions(Options{NumColors: maxNetSize, SamplingFactor: 1})
 }
 
 // NewWithSamplingFactor returns a new Kohonen neural network color quantizer
-// with the specified sampling factor. The sampling factor must be in the
-// range [1,30]. Higher numbers reduce computation time at the expense of
-// image quality.
+// with the specified sampling factor and a palette of 256 colors. The
+// sampling factor must be in the range [1,30]. Higher numbers reduce
+// computation time at the expense of image quality.
 func NewWithSamplingFactor(sample int) draw.Quantizer {
-	if sample < 1 || sample > 30 {
-		panic("sample must be between 1 and 30")
+	return NewWithOptions(Options{NumColors: maxNetSize, SamplingFactor: sample})
+}
+
+// NewWithOptions returns a new Kohonen neural network color quantizer
+// configured by o. It panics if o.NumColors is not in the range [4,256] or
+// if o.SamplingFactor is not in the range [1,30].
+func NewWithOptions(o Options) *Quantizer {
+	if o.NumColors <= specials || o.NumColors > maxNetSize {
+		panic("neuquant: NumColors must be between 4 and 256")
+	}
+	if o.SamplingFactor < 1 || o.SamplingFactor > 30 {
+		panic("neuquant: SamplingFactor must be between 1 and 30")
+	}
+	return &Quantizer{
+		numColors:  o.NumColors,
+		size:       o.NumColors,
+		sampleFac:  o.SamplingFactor,
+		dither:     o.Dither,
+		arithmetic: o.Arithmetic,
 	}
-	return &quantizer{sampleFac: sample}
 }
 
 // Quantize creates a color palette suitable for converting m to a palleted
-// image.
-func (q *quantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+// image. The number of colors produced is the NumColors the Quantizer was
+// configured with, unless p was created with a smaller capacity (as
+// image/gif does when given a gif.Options.NumColors), in which case that
+// smaller capacity is honored instead. The palette never has fewer than
+// specials+1 (4) colors, even when cap(p) is smaller than that.
+func (q *Quantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	size := q.numColors
+	if c := cap(p); c > 0 && c < size {
+		size = c
+	}
+	if size < specials+1 {
+		size = specials + 1
+	}
+	q.allocate(size)
 	q.setPixels(m)
-	q.setUpArrays()
-	q.learn()
-	q.fix()
+	if q.arithmetic == FloatArithmetic {
+		q.setUpArrays()
+		q.learn()
+		q.fix()
+	} else {
+		q.setUpArraysInt()
+		q.learnInt()
+		q.fixInt()
+	}
 	q.inxBuild()
 	return makePalette(q.colorMap)
 }
 
-func (q *quantizer) setPixels(im image.Image) {
-	pixels, err := extractPixels(im)
-	if err != nil {
-		panic(err)
+func (q *Quantizer) allocate(size int) {
+	q.size = size
+	q.colorMap = make([][3]int, size)
+	if q.arithmetic == FloatArithmetic {
+		q.network = make([][3]float64, size)
+		q.bias = make([]float64, size)
+		q.freq = make([]float64, size)
+	} else {
+		q.networkInt = make([][3]int32, size)
+		q.biasInt = make([]int32, size)
+		q.freqInt = make([]int32, size)
 	}
-	q.pixels = pixels[:]
 }
 
-func (q *quantizer) setUpArrays() {
+func (q *Quantizer) setPixels(im image.Image) {
+	q.pixels = sample(im, im.Bounds().Dx()*im.Bounds().Dy()/q.sampleFac)
+}
+
+func (q *Quantizer) setUpArrays() {
 	q.network[0][0] = 0.0 // Black.
 	q.network[0][1] = 0.0
 	q.network[0][2] = 0.0
@@ -120,56 +185,46 @@ func (q *quantizer) setUpArrays() {
 	q.network[1][2] = 255.0
 
 	for i := 0; i < specials; i++ {
-		q.freq[i] = 1.0 / float64(netSize)
+		q.freq[i] = 1.0 / float64(q.size)
 		q.bias[i] = 0.0
 	}
 
-	cutNetSize := netSize - specials
-	for i := specials; i < netSize; i++ {
+	cutNetSize := q.size - specials
+	for i := specials; i < q.size; i++ {
 		p := q.network[i][:]
 		p[0] = (255.0 * float64(i-specials)) / float64(cutNetSize)
 		p[1] = (255.0 * float64(i-specials)) / float64(cutNetSize)
 		p[2] = (255.0 * float64(i-specials)) / float64(cutNetSize)
 
-		q.freq[i] = 1.0 / float64(netSize)
+		q.freq[i] = 1.0 / float64(q.size)
 		q.bias[i] = 0.0
 	}
 }
 
-func (q *quantizer) learn() {
+func (q *Quantizer) learn() {
+	initRad := q.size / 8
+	if initRad < 1 {
+		initRad = 1
+	}
+	initBiasRad := initRad * radBias
+
 	biasRad := initBiasRad
 	alphaDec := 30 + ((q.sampleFac - 1) / 3)
-	lengthCount := len(q.pixels)
-	samplePixels := lengthCount / q.sampleFac
+	samplePixels := len(q.pixels) / 3
 	delta := samplePixels / numCycles
+	if delta < 1 {
+		delta = 1
+	}
 	alpha := initAlpha
 
 	rad := calcRad(biasRad)
 
-	step, pos := 0, 0
-
-	if lengthCount%prime1 != 0 {
-		step = prime1
-	} else {
-		if lengthCount%prime2 != 0 {
-			step = prime2
-		} else {
-			if lengthCount%prime3 != 0 {
-				step = prime3
-			} else {
-				step = prime4
-			}
-		}
-	}
-
-	i := 0
+	i, pos := 0, 0
 	for i < samplePixels {
-		p := q.pixels[pos]
-		red := uint32((p >> 16) & 0xFF)
-		green := uint32((p >> 8) & 0xFF)
-		blue := uint32(p & 0xFF)
-
-		r, g, b := float64(red), float64(green), float64(blue)
+		o := pos * 3
+		r := float64(q.pixels[o])
+		g := float64(q.pixels[o+1])
+		b := float64(q.pixels[o+2])
 
 		// Remember background color.
 		if bgColor := specials - 1; i == 0 {
@@ -192,8 +247,10 @@ func (q *quantizer) learn() {
 			}
 		}
 
-		pos += step
-		pos = pos % lengthCount
+		pos++
+		if pos >= samplePixels {
+			pos = 0
+		}
 
 		i++
 		if i%delta == 0 {
@@ -204,8 +261,8 @@ func (q *quantizer) learn() {
 	}
 }
 
-func (q *quantizer) fix() {
-	for i := 0; i < netSize; i++ {
+func (q *Quantizer) fix() {
+	for i := 0; i < q.size; i++ {
 		for j := 0; j < 3; j++ {
 			q.colorMap[i][j] = roundToColorValue(q.network[i][j])
 		}
@@ -213,15 +270,15 @@ func (q *quantizer) fix() {
 }
 
 // Insertion sort of network and building of netIndex[0..255]
-func (q *quantizer) inxBuild() {
-	maxNetPos := netSize - 1
+func (q *Quantizer) inxBuild() {
+	maxNetPos := q.size - 1
 	prevCol, startPos := 0, 0
 
-	for i := 0; i < netSize; i++ {
+	for i := 0; i < q.size; i++ {
 		p := q.colorMap[i][:]
 		smallPos, smallVal := i, p[1]
 
-		for j := i + 1; j < netSize; j++ {
+		for j := i + 1; j < q.size; j++ {
 			c := q.colorMap[j][:]
 			if c[1] < smallVal {
 				smallPos = j
@@ -247,13 +304,13 @@ func (q *quantizer) inxBuild() {
 		}
 	}
 	q.netIndex[prevCol] = (startPos + maxNetPos) >> 1
-	for j := prevCol + 1; j < 256; j++ {
+	for j := prevCol + 1; j < maxNetSize; j++ {
 		q.netIndex[j] = maxNetPos
 	}
 }
 
 // Move neuron i towards (r, g, b).
-func (q *quantizer) alterSingle(alpha float64, i int, r, g, b float64) {
+func (q *Quantizer) alterSingle(alpha float64, i int, r, g, b float64) {
 	p := q.network[i][:]
 	p[0] -= alpha * (p[0] - r)
 	p[1] -= alpha * (p[1] - g)
@@ -261,13 +318,13 @@ func (q *quantizer) alterSingle(alpha float64, i int, r, g, b float64) {
 }
 
 // Move all neurons that are at most rad away from i towards (r, g, b).
-func (q *quantizer) alterNeighbors(alpha float64, rad int, i int, r, g, b float64) {
+func (q *Quantizer) alterNeighbors(alpha float64, rad int, i int, r, g, b float64) {
 	lo, hi := i-rad, i+rad
 	if lo < specials {
 		lo = specials - 1
 	}
-	if hi > netSize {
-		hi = netSize
+	if hi > q.size {
+		hi = q.size
 	}
 
 	j, k := i+1, i-1
@@ -297,13 +354,13 @@ func (q *quantizer) alterNeighbors(alpha float64, rad int, i int, r, g, b float6
 // its position. For frequently chosen neurons, freq[i] is high and bias[i] is
 // negative.
 // bias[i] = gamma * ((1 / netSize) - freq[i])
-func (q *quantizer) contest(r, g, b float64) int {
+func (q *Quantizer) contest(r, g, b float64) int {
 	bestDist := math.MaxFloat64
 	bestBiasDist := bestDist
 	bestPos := -1
 	bestBiasPos := bestPos
 
-	for i := specials; i < netSize; i++ {
+	for i := specials; i < q.size; i++ {
 		p := q.network[i][:]
 		dist := math.Abs(p[0]-r) + math.Abs(p[1]-g) + math.Abs(p[2]-b)
 		if dist < bestDist {
@@ -323,7 +380,7 @@ func (q *quantizer) contest(r, g, b float64) int {
 	return bestBiasPos
 }
 
-func (q *quantizer) specialFind(r, g, b float64) int {
+func (q *Quantizer) specialFind(r, g, b float64) int {
 	for i := 0; i < specials; i++ {
 		p := q.network[i][:]
 		if eqFloat(p[0], r) && eqFloat(p[1], g) && eqFloat(p[2], b) {
@@ -333,23 +390,6 @@ func (q *quantizer) specialFind(r, g, b float64) int {
 	return -1
 }
 
-func extractPixels(m image.Image) ([]int, error) {
-	w := m.Bounds().Max.X
-	h := m.Bounds().Max.Y
-	if w*h < prime4 {
-		return nil, errors.New("image is too small")
-	}
-	var pixels []int
-	for y := m.Bounds().Min.Y; y < h; y++ {
-		for x := m.Bounds().Min.X; x < w; x++ {
-			r, g, b, _ := m.At(x, y).RGBA()
-			px := int((r << 16) | (g << 8) | b)
-			pixels = append(pixels, px)
-		}
-	}
-	return pixels, nil
-}
-
 func calcRad(bias int) int {
 	rad := bias >> radBiasShift
 	if rad <= 1 {
@@ -372,16 +412,15 @@ func roundToColorValue(x float64) int {
 	return res
 }
 
-func makePalette(colorMap [netSize][3]int) color.Palette {
-	var res color.Palette
-	for i := 0; i < netSize; i++ {
-		c := color.RGBA{
-			R: uint8(colorMap[i][0]),
-			G: uint8(colorMap[i][1]),
-			B: uint8(colorMap[i][2]),
+func makePalette(colorMap [][3]int) color.Palette {
+	res := make(color.Palette, len(colorMap))
+	for i, c := range colorMap {
+		res[i] = color.RGBA{
+			R: uint8(c[0]),
+			G: uint8(c[1]),
+			B: uint8(c[2]),
 			A: 0xFF,
 		}
-		res = append(res, c)
 	}
 	return res
 }
@@ -3,8 +3,11 @@ package neuquant
 import (
 	"bytes"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/gif"
 	_ "image/jpeg"
+	"math"
 	"os"
 	"reflect"
 	"testing"
@@ -35,15 +38,333 @@ func TestQuantize(t *testing.T) {
 	}
 }
 
-func TestExtractPixels(t *testing.T) {
+// TestQuantizeSmallNumColors checks that Quantize cooperates with
+// gif.Options.NumColors values below specials+1, which image/gif permits
+// (it keeps any NumColors in 1..256) but which cannot address a full
+// network of specials.
+func TestQuantizeSmallNumColors(t *testing.T) {
+	m := gradientImage(64, 64)
+	for _, numColors := range []int{1, 2, 3, specials} {
+		t.Run("", func(t *testing.T) {
+			q := New()
+			buf := new(bytes.Buffer)
+			err := gif.Encode(buf, m, &gif.Options{Quantizer: q, NumColors: numColors})
+			if err != nil {
+				t.Fatalf("Failed to encode image with NumColors=%d: %v", numColors, err)
+			}
+			g, err := gif.DecodeAll(buf)
+			if err != nil {
+				t.Fatalf("Failed to decode gif: %v", err)
+			}
+			want := numColors
+			if want < specials+1 {
+				want = specials + 1
+			}
+			if n := len(g.Image[0].Palette); n > want {
+				t.Errorf("len(Palette) = %d, want <= %d", n, want)
+			}
+		})
+	}
+}
+
+// TestQuantizeDoesNotShrinkPermanently checks that a Quantizer reused across
+// calls to Quantize returns to its configured NumColors once a call with a
+// larger cap(p) follows one that was shrunk by a smaller cap(p), rather than
+// staying locked at the smallest size ever requested.
+func TestQuantizeDoesNotShrinkPermanently(t *testing.T) {
+	m := gradientImage(64, 64)
+	q := NewWithOptions(Options{NumColors: 256, SamplingFactor: 1})
+
+	q.Quantize(make(color.Palette, 0, 16), m)
+	p := q.Quantize(make(color.Palette, 0, 256), m)
+	if n := len(p); n != 256 {
+		t.Errorf("len(Quantize()) after shrunk call = %d, want 256", n)
+	}
+}
+
+func TestSample(t *testing.T) {
 	m := mustReadImg(t, imgFilename)
-	pixels, err := extractPixels(m)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	const target = 1000
+	pixels := sample(m, target)
+	if n, want := len(pixels), target*3; n != want {
+		t.Errorf("len(sample(m, %d)) = %d, want %d", target, n, want)
+	}
+
+	full := sample(m, imgWidth*imgHeight)
+	if n, want := len(full), imgWidth*imgHeight*3; n != want {
+		t.Errorf("len(sample(m, W*H)) = %d, want %d", n, want)
 	}
-	if n, want := len(pixels), imgWidth*imgHeight; n != want {
-		t.Errorf("len(pixels) = %d, want %d", n, want)
+}
+
+// TestSampleZeroArea checks that sample doesn't divide by zero on an
+// image with an empty bounds rectangle.
+func TestSampleZeroArea(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 0, 0))
+	if pixels := sample(m, 100); pixels != nil {
+		t.Errorf("sample(zero-area image, 100) = %v, want nil", pixels)
+	}
+}
+
+// TestSampleStride checks that sample's skip schedule averages the
+// intended stride (total/target), rather than overshooting it, so that a
+// SamplingFactor of 1 visits (approximately) every pixel.
+func TestSampleStride(t *testing.T) {
+	m := gradientImage(200, 200)
+	total := 200 * 200
+	for _, fac := range []int{1, 2, 4, 30} {
+		target := total / fac
+		got := len(sample(m, target)) / 3
+		if lo, hi := target*95/100, target*105/100; got < lo || got > hi {
+			t.Errorf("sampleFac=%d: len(sample(m, %d))/3 = %d, want within 5%% of %d", fac, target, got, target)
+		}
+	}
+}
+
+// TestMapperIndex checks that Mapper.Index agrees with a brute-force
+// Manhattan-distance nearest-neighbor search over the trained palette, for
+// every pixel of the training image.
+func TestMapperIndex(t *testing.T) {
+	m := gradientImage(64, 64)
+	q := NewWithOptions(Options{NumColors: 32, SamplingFactor: 1})
+	q.Quantize(nil, m)
+	mp := q.Mapper()
+
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r32, g32, b32, _ := m.At(x, y).RGBA()
+			r, g, bl := int(r32>>8), int(g32>>8), int(b32>>8)
+
+			wantDist := bruteForceBestDist(q.colorMap, r, g, bl)
+			got := mp.Index(m.At(x, y))
+			p := q.colorMap[got]
+			if gotDist := iabs(p[0]-r) + iabs(p[1]-g) + iabs(p[2]-bl); gotDist != wantDist {
+				t.Fatalf("Mapper.Index(%d, %d, %d) picked dist %d, want %d (brute force)", r, g, bl, gotDist, wantDist)
+			}
+		}
+	}
+}
+
+// TestDrawPaletted checks that DrawPaletted produces an image with the same
+// bounds and palette-valid indices as the source, both with and without
+// dithering.
+func TestDrawPaletted(t *testing.T) {
+	for _, dither := range []Ditherer{NoDither, FloydSteinberg} {
+		m := gradientImage(64, 64)
+		q := NewWithOptions(Options{NumColors: 32, SamplingFactor: 1, Dither: dither})
+		p := q.Quantize(nil, m)
+
+		dst := image.NewPaletted(m.Bounds(), p)
+		q.DrawPaletted(dst, m)
+
+		if dst.Bounds() != m.Bounds() {
+			t.Errorf("dither=%v: Bounds() = %v, want %v", dither, dst.Bounds(), m.Bounds())
+		}
+		b := m.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if idx := dst.ColorIndexAt(x, y); int(idx) >= len(p) {
+					t.Fatalf("dither=%v: ColorIndexAt(%d, %d) = %d, want < %d", dither, x, y, idx, len(p))
+				}
+			}
+		}
+	}
+}
+
+func bruteForceBestDist(colorMap [][3]int, r, g, b int) int {
+	bestDist := int(^uint(0) >> 1)
+	for _, p := range colorMap {
+		if dist := iabs(p[0]-r) + iabs(p[1]-g) + iabs(p[2]-b); dist < bestDist {
+			bestDist = dist
+		}
+	}
+	return bestDist
+}
+
+// TestArithmeticEquivalence checks that IntegerArithmetic and FloatArithmetic
+// agree to within ±1 per channel on the two deterministic stages of the
+// algorithm: the initial network layout and a single learning step. Full
+// trained palettes are not compared pixel-for-pixel here, since the contest
+// is a chaotic process where the tiny rounding differences between the two
+// numeric representations compound over the hundred learning cycles; see
+// TestArithmeticEquivalenceEndToEnd for a looser full-schedule comparison.
+func TestArithmeticEquivalence(t *testing.T) {
+	m := gradientImage(64, 64)
+
+	qf := NewWithOptions(Options{NumColors: 32, SamplingFactor: 1, Arithmetic: FloatArithmetic})
+	qi := NewWithOptions(Options{NumColors: 32, SamplingFactor: 1, Arithmetic: IntegerArithmetic})
+
+	qf.allocate(32)
+	qf.setPixels(m)
+	qf.setUpArrays()
+
+	qi.allocate(32)
+	qi.setPixels(m)
+	qi.setUpArraysInt()
+
+	for i := 0; i < 32; i++ {
+		for c := 0; c < 3; c++ {
+			want := qf.network[i][c]
+			got := float64(qi.networkInt[i][c]) / float64(int32(1)<<netBiasShift)
+			if d := math.Abs(want - got); d > 1 {
+				t.Errorf("network[%d][%d] = %v, networkInt scaled = %v, differ by %v, want <= 1", i, c, want, got, d)
+			}
+		}
 	}
+
+	// One learning step towards an arbitrary, well-separated color should
+	// move both networks' winning neuron to the same place, within the
+	// same ±1 per channel tolerance.
+	r, g, b := 200.0, 40.0, 90.0
+	jf := qf.contest(r, g, b)
+	qf.alterSingle(1.0, jf, r, g, b)
+
+	ri, gi, bi := int32(r)<<netBiasShift, int32(g)<<netBiasShift, int32(b)<<netBiasShift
+	ji := qi.contestInt(ri, gi, bi)
+	qi.alterSingleInt(initAlpha, ji, ri, gi, bi)
+
+	if jf != ji {
+		t.Fatalf("contest winner = %d, contestInt winner = %d, want equal", jf, ji)
+	}
+	for c := 0; c < 3; c++ {
+		want := qf.network[jf][c]
+		got := float64(qi.networkInt[ji][c]) / float64(int32(1)<<netBiasShift)
+		if d := math.Abs(want - got); d > 1 {
+			t.Errorf("after alterSingle, network[%d][%d] = %v, networkInt scaled = %v, differ by %v, want <= 1", jf, c, want, got, d)
+		}
+	}
+}
+
+// TestArithmeticEquivalenceEndToEnd runs a full multi-cycle training pass
+// with both backends and checks that every color in each resulting palette
+// has a reasonably close match in the other's, the way a user comparing
+// IntegerArithmetic (the default) against FloatArithmetic would judge it.
+// The tolerance is deliberately loose: the contest is a chaotic process and
+// tiny rounding differences between the two numeric representations compound
+// over the hundred learning cycles, so this cannot assert per-channel ±1
+// agreement. It is sized to catch a gross regression in the int path's
+// contest or neighbor-update logic (which diverges by 3-6x as much), not to
+// enforce tight agreement.
+func TestArithmeticEquivalenceEndToEnd(t *testing.T) {
+	m := gradientImage(64, 64)
+
+	qf := NewWithOptions(Options{NumColors: 32, SamplingFactor: 1, Arithmetic: FloatArithmetic})
+	qi := NewWithOptions(Options{NumColors: 32, SamplingFactor: 1, Arithmetic: IntegerArithmetic})
+
+	pf := qf.Quantize(nil, m)
+	pi := qi.Quantize(nil, m)
+
+	const maxAvgDist = 60.0
+	if d := avgNearestDist(pf, pi); d > maxAvgDist {
+		t.Errorf("avg nearest distance from float palette to int palette = %v, want <= %v", d, maxAvgDist)
+	}
+	if d := avgNearestDist(pi, pf); d > maxAvgDist {
+		t.Errorf("avg nearest distance from int palette to float palette = %v, want <= %v", d, maxAvgDist)
+	}
+}
+
+// avgNearestDist returns, for every color in a, its Manhattan distance to
+// the closest color in b, averaged over a.
+func avgNearestDist(a, b color.Palette) float64 {
+	total := 0
+	for _, c := range a {
+		r, g, bl, _ := c.RGBA()
+		rr, gg, bb := int(r>>8), int(g>>8), int(bl>>8)
+		best := int(^uint(0) >> 1)
+		for _, c2 := range b {
+			r2, g2, b2, _ := c2.RGBA()
+			if dist := iabs(int(r2>>8)-rr) + iabs(int(g2>>8)-gg) + iabs(int(b2>>8)-bb); dist < best {
+				best = dist
+			}
+		}
+		total += best
+	}
+	return float64(total) / float64(len(a))
+}
+
+// genericImage hides the concrete type of its embedded image.Image, forcing
+// pixelReader onto its generic, non-fast-pathed code path.
+type genericImage struct {
+	image.Image
+}
+
+func TestPixelReaderOffsetBounds(t *testing.T) {
+	const w, h = 40, 30
+	r := image.Rect(-7, 13, -7+w, 13+h) // Negative, non-zero Min.
+
+	tests := []struct {
+		name string
+		img  draw.Image
+	}{
+		{"RGBA", image.NewRGBA(r)},
+		{"NRGBA", image.NewNRGBA(r)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					tt.img.Set(x, y, color.NRGBA{
+						R: uint8(x - r.Min.X),
+						G: uint8(y - r.Min.Y),
+						B: uint8((x - r.Min.X) + (y - r.Min.Y)),
+						A: uint8(128 + x%128),
+					})
+				}
+			}
+
+			fast := pixelReader(tt.img)
+			generic := pixelReader(genericImage{tt.img})
+
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					fr, fg, fb := fast(x, y)
+					gr, gg, gb := generic(x, y)
+					if fr != gr || fg != gg || fb != gb {
+						t.Errorf("pixelReader(%s)(%d, %d) = (%d, %d, %d), want (%d, %d, %d) (generic path)",
+							tt.name, x, y, fr, fg, fb, gr, gg, gb)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMultiFrame(t *testing.T) {
+	frame1 := gradientImage(64, 64)
+	frame2 := gradientImage(32, 96)
+
+	q := NewWithOptions(Options{NumColors: 32, SamplingFactor: 1})
+	q.AddFrame(frame1)
+	q.AddFrame(frame2)
+	p := q.Palette()
+	if n := len(p); n != 32 {
+		t.Fatalf("len(Palette()) = %d, want 32", n)
+	}
+
+	for _, frame := range []image.Image{frame1, frame2} {
+		m := q.MapFrame(frame)
+		if !reflect.DeepEqual(m.Palette, p) {
+			t.Errorf("MapFrame(%v).Palette = %v, want %v", frame.Bounds(), m.Palette, p)
+		}
+		if m.Bounds() != frame.Bounds() {
+			t.Errorf("MapFrame(%v).Bounds() = %v, want %v", frame.Bounds(), m.Bounds(), frame.Bounds())
+		}
+	}
+}
+
+func gradientImage(w, h int) image.Image {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.Set(x, y, color.RGBA{
+				R: uint8(x * 255 / w),
+				G: uint8(y * 255 / h),
+				B: uint8((x + y) * 255 / (w + h)),
+				A: 0xFF,
+			})
+		}
+	}
+	return m
 }
 
 func mustReadImg(t *testing.T, filename string) image.Image {
@@ -0,0 +1,95 @@
+package neuquant
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+)
+
+// maxSkip caps the distance sample will ever jump between two retained
+// pixels, matching the Radiance neural-net quantizer's skip-count sampler.
+const maxSkip = 1<<24 - 1
+
+// sample streams m once, row by row in order, and returns a reservoir of
+// roughly target RGB triples chosen by a skip-count schedule: rather than
+// visiting every pixel, it advances by a pseudo-random run of pixels
+// between retained samples, so memory is O(target) instead of O(w·h) and
+// the source image is only ever touched once. The schedule is seeded from
+// m's dimensions, so a given image and target always yield the same
+// reservoir.
+func sample(m image.Image, target int) []uint8 {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	total := w * h
+	if total == 0 {
+		return nil
+	}
+	if target <= 0 || target > total {
+		target = total
+	}
+
+	avgSkip := total / target
+	if avgSkip < 1 {
+		avgSkip = 1
+	}
+
+	read := pixelReader(m)
+	rnd := rand.New(rand.NewSource(int64(w)<<32 | int64(h)))
+
+	reservoir := make([]uint8, 0, target*3)
+	for pos := 0; pos < total && len(reservoir) < target*3; {
+		x, y := b.Min.X+pos%w, b.Min.Y+pos/w
+		r, g, bl := read(x, y)
+		reservoir = append(reservoir, r, g, bl)
+
+		// skip averages avgSkip-1, so the stride (1 + skip) averages avgSkip.
+		skip := rnd.Intn(2*(avgSkip-1) + 1)
+		if skip > maxSkip {
+			skip = maxSkip
+		}
+		pos += 1 + skip
+	}
+	return reservoir
+}
+
+// pixelReader returns a function giving the RGB triple at image coordinates
+// (x, y) within m, fast-pathing the concrete types produced by the standard
+// library decoders to avoid the image.Image interface and color.Color
+// boxing on every sampled pixel.
+func pixelReader(m image.Image) func(x, y int) (r, g, b uint8) {
+	switch src := m.(type) {
+	case *image.RGBA:
+		return func(x, y int) (uint8, uint8, uint8) {
+			o := src.PixOffset(x, y)
+			return src.Pix[o], src.Pix[o+1], src.Pix[o+2]
+		}
+	case *image.NRGBA:
+		return func(x, y int) (uint8, uint8, uint8) {
+			o := src.PixOffset(x, y)
+			a := src.Pix[o+3]
+			return premul8(src.Pix[o], a), premul8(src.Pix[o+1], a), premul8(src.Pix[o+2], a)
+		}
+	case *image.YCbCr:
+		return func(x, y int) (uint8, uint8, uint8) {
+			yi := src.YOffset(x, y)
+			ci := src.COffset(x, y)
+			return color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+		}
+	default:
+		return func(x, y int) (uint8, uint8, uint8) {
+			r, g, bl, _ := m.At(x, y).RGBA()
+			return uint8(r >> 8), uint8(g >> 8), uint8(bl >> 8)
+		}
+	}
+}
+
+// premul8 alpha-premultiplies an 8-bit non-premultiplied channel value the
+// same way color.NRGBA.RGBA does, so the fast *image.NRGBA path agrees with
+// the generic m.At(x, y).RGBA() path.
+func premul8(v, a uint8) uint8 {
+	v16 := uint32(v)
+	v16 |= v16 << 8
+	v16 *= uint32(a)
+	v16 /= 0xff
+	return uint8(v16 >> 8)
+}